@@ -53,9 +53,20 @@ var registerMetrics sync.Once
 // Register all metrics.
 func Register() {
 	registerMetrics.Do(func() {
+		apiserverRequestWaitingSeconds = compbasemetrics.NewHistogramVec(
+			newRequestDurationHistogramOpts("request_wait_duration_seconds", "Length of time a request spent waiting in its queue"),
+			[]string{priorityLevel, flowSchema, "execute"},
+		)
+		apiserverRequestExecutionSeconds = compbasemetrics.NewHistogramVec(
+			newRequestDurationHistogramOpts("request_execution_seconds", "Duration of regular phase of request execution in the API Priority and Fairness system"),
+			[]string{priorityLevel, flowSchema, "type"},
+		)
+		metrics = metrics.Append(apiserverRequestWaitingSeconds, apiserverRequestExecutionSeconds)
+
 		for _, metric := range metrics {
 			legacyregistry.MustRegister(metric)
 		}
+		StartRateSampler(context.Background())
 	})
 }
 
@@ -268,28 +279,12 @@ var (
 		},
 		[]string{priorityLevel, flowSchema},
 	)
-	apiserverRequestWaitingSeconds = compbasemetrics.NewHistogramVec(
-		&compbasemetrics.HistogramOpts{
-			Namespace:      namespace,
-			Subsystem:      subsystem,
-			Name:           "request_wait_duration_seconds",
-			Help:           "Length of time a request spent waiting in its queue",
-			Buckets:        requestDurationSecondsBuckets,
-			StabilityLevel: compbasemetrics.ALPHA,
-		},
-		[]string{priorityLevel, flowSchema, "execute"},
-	)
-	apiserverRequestExecutionSeconds = compbasemetrics.NewHistogramVec(
-		&compbasemetrics.HistogramOpts{
-			Namespace:      namespace,
-			Subsystem:      subsystem,
-			Name:           "request_execution_seconds",
-			Help:           "Duration of regular phase of request execution in the API Priority and Fairness system",
-			Buckets:        requestDurationSecondsBuckets,
-			StabilityLevel: compbasemetrics.ALPHA,
-		},
-		[]string{priorityLevel, flowSchema, "type"},
-	)
+	// apiserverRequestWaitingSeconds and apiserverRequestExecutionSeconds are
+	// constructed lazily, by Register, since whether they use native
+	// (exponential) histograms depends on options that must be set via
+	// ConfigureNativeHistograms before Register runs.
+	apiserverRequestWaitingSeconds   *compbasemetrics.HistogramVec
+	apiserverRequestExecutionSeconds *compbasemetrics.HistogramVec
 	watchCountSamples = compbasemetrics.NewHistogramVec(
 		&compbasemetrics.HistogramOpts{
 			Namespace:      namespace,
@@ -338,8 +333,6 @@ var (
 		apiserverRequestConcurrencyLimit,
 		apiserverRequestConcurrencyInUse,
 		apiserverCurrentExecutingRequests,
-		apiserverRequestWaitingSeconds,
-		apiserverRequestExecutionSeconds,
 		watchCountSamples,
 		apiserverEpochAdvances,
 		apiserverWorkEstimatedSeats,
@@ -388,21 +381,25 @@ func UpdateSharedConcurrencyLimit(priorityLevel string, limit int) {
 // AddReject increments the # of rejected requests for flow control
 func AddReject(ctx context.Context, priorityLevel, flowSchema, reason string) {
 	apiserverRejectedRequestsTotal.WithContext(ctx).WithLabelValues(priorityLevel, flowSchema, reason).Add(1)
+	currentEventSink().Reject(ctx, priorityLevel, flowSchema, reason)
 }
 
 // AddDispatch increments the # of dispatched requests for flow control
 func AddDispatch(ctx context.Context, priorityLevel, flowSchema string) {
 	apiserverDispatchedRequestsTotal.WithContext(ctx).WithLabelValues(priorityLevel, flowSchema).Add(1)
+	currentEventSink().Dispatch(ctx, priorityLevel, flowSchema)
 }
 
 // ObserveQueueLength observes the queue length for flow control
 func ObserveQueueLength(ctx context.Context, priorityLevel, flowSchema string, length int) {
 	apiserverRequestQueueLength.WithContext(ctx).WithLabelValues(priorityLevel, flowSchema).Observe(float64(length))
+	currentEventSink().Enqueue(ctx, priorityLevel, flowSchema, length)
 }
 
 // ObserveWaitingDuration observes the queue length for flow control
 func ObserveWaitingDuration(ctx context.Context, priorityLevel, flowSchema, execute string, waitTime time.Duration) {
 	apiserverRequestWaitingSeconds.WithContext(ctx).WithLabelValues(priorityLevel, flowSchema, execute).Observe(waitTime.Seconds())
+	currentEventSink().Wait(ctx, priorityLevel, flowSchema, execute, waitTime)
 }
 
 // ObserveExecutionDuration observes the execution duration for flow control
@@ -412,6 +409,7 @@ func ObserveExecutionDuration(ctx context.Context, priorityLevel, flowSchema str
 		reqType = requestInfo.Verb
 	}
 	apiserverRequestExecutionSeconds.WithContext(ctx).WithLabelValues(priorityLevel, flowSchema, reqType).Observe(executionTime.Seconds())
+	currentEventSink().ExecutionEnd(ctx, priorityLevel, flowSchema, executionTime)
 }
 
 // ObserveWatchCount notes a sampling of a watch count
@@ -427,4 +425,11 @@ func AddEpochAdvance(ctx context.Context, priorityLevel string, success bool) {
 // ObserveWorkEstimatedSeats notes a sampling of estimated seats associated with a request
 func ObserveWorkEstimatedSeats(priorityLevel, flowSchema string, seats int) {
 	apiserverWorkEstimatedSeats.WithLabelValues(priorityLevel, flowSchema).Observe(float64(seats))
+	// Unlike its siblings above, this hook isn't on a path that carries the
+	// request context today, so the default spanEventSink has no span to
+	// attach an apf.estimated_seats event to and the call below is a no-op
+	// for it; a background context is still passed, rather than skipping
+	// the call outright, so a non-span-based RequestEventSink installed via
+	// SetRequestEventSink still observes every estimated-seats sample.
+	currentEventSink().EstimatedSeats(context.TODO(), priorityLevel, flowSchema, seats)
 }
@@ -0,0 +1,106 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"time"
+
+	compbasemetrics "k8s.io/component-base/metrics"
+)
+
+// NativeHistogramOptions configures the Prometheus native (exponential)
+// histograms used for the wait-duration and execution-duration metrics.
+// Set it via ConfigureNativeHistograms before calling Register; the zero
+// value leaves the classic, fixed-bucket histograms in place for backward
+// compatibility.
+type NativeHistogramOptions struct {
+	// Enabled turns on native histograms for
+	// apiserver_flowcontrol_request_wait_duration_seconds and
+	// apiserver_flowcontrol_request_execution_seconds. Callers are
+	// expected to gate this on their own feature gate (e.g. an
+	// APIPriorityAndFairnessNativeHistograms alpha gate) before turning
+	// it on, since this package does not depend on the feature gate
+	// machinery itself.
+	Enabled bool
+	// Factor is the growth factor between adjacent native histogram
+	// buckets (Prometheus calls this the "schema"). Smaller values give
+	// finer resolution at the cost of more buckets. Defaults to 1.1.
+	Factor float64
+	// MaxBuckets bounds how many buckets a single native histogram series
+	// may use before Prometheus's client-side bucket limiter starts
+	// merging adjacent buckets. Defaults to 100.
+	MaxBuckets uint32
+	// MinResetDuration is the minimum time between automatic resets of a
+	// native histogram's bucket schema, used to recover resolution after
+	// a burst forces bucket merging. Defaults to 1h.
+	MinResetDuration time.Duration
+}
+
+// DefaultNativeHistogramOptions returns the native histogram defaults used
+// when ConfigureNativeHistograms is never called or is called with a zero
+// Factor/MaxBuckets/MinResetDuration.
+func DefaultNativeHistogramOptions() NativeHistogramOptions {
+	return NativeHistogramOptions{
+		Factor:           1.1,
+		MaxBuckets:       100,
+		MinResetDuration: time.Hour,
+	}
+}
+
+// nativeHistogramOptions holds the options ConfigureNativeHistograms was
+// last called with; it is read once, by Register, when the wait/execution
+// duration histograms are constructed.
+var nativeHistogramOptions = NativeHistogramOptions{}
+
+// ConfigureNativeHistograms sets the native histogram options used for the
+// wait-duration and execution-duration histograms. It must be called
+// before Register to take effect; calling it afterward has no effect on
+// the already-registered histograms.
+func ConfigureNativeHistograms(opts NativeHistogramOptions) {
+	if opts.Factor <= 0 {
+		opts.Factor = DefaultNativeHistogramOptions().Factor
+	}
+	if opts.MaxBuckets == 0 {
+		opts.MaxBuckets = DefaultNativeHistogramOptions().MaxBuckets
+	}
+	if opts.MinResetDuration == 0 {
+		opts.MinResetDuration = DefaultNativeHistogramOptions().MinResetDuration
+	}
+	nativeHistogramOptions = opts
+}
+
+// newRequestDurationHistogramOpts builds the HistogramOpts for one of the
+// request duration histograms, applying native histogram settings on top
+// of the classic buckets when native histograms are enabled. The classic
+// buckets are always included so that a native histogram can still fall
+// back to them (and so the metric is unchanged when the feature is off).
+func newRequestDurationHistogramOpts(name, help string) *compbasemetrics.HistogramOpts {
+	opts := &compbasemetrics.HistogramOpts{
+		Namespace:      namespace,
+		Subsystem:      subsystem,
+		Name:           name,
+		Help:           help,
+		Buckets:        requestDurationSecondsBuckets,
+		StabilityLevel: compbasemetrics.ALPHA,
+	}
+	if nativeHistogramOptions.Enabled {
+		opts.NativeHistogramBucketFactor = nativeHistogramOptions.Factor
+		opts.NativeHistogramMaxBucketNumber = nativeHistogramOptions.MaxBuckets
+		opts.NativeHistogramMinResetDuration = nativeHistogramOptions.MinResetDuration
+	}
+	return opts
+}
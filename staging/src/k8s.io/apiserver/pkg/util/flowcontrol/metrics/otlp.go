@@ -0,0 +1,330 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+)
+
+// defaultOTLPPushInterval is how often the OTLP exporter pulls the current
+// state of the APF metrics out of the legacy registry and pushes it to the
+// configured collector.
+const defaultOTLPPushInterval = 15 * time.Second
+
+// OTLPExporterOptions configures the OTLP push path for APF metrics.
+type OTLPExporterOptions struct {
+	// Endpoint is the host:port of the OTLP/gRPC collector to push to.
+	Endpoint string
+	// Headers are added to every export request, e.g. for collector auth.
+	Headers map[string]string
+	// TLSConfig, when non-nil, is used to dial Endpoint over TLS. A nil
+	// value means the connection is established insecurely.
+	TLSConfig *tls.Config
+	// PushInterval is how often metrics are pulled and pushed. Defaults to
+	// defaultOTLPPushInterval when zero.
+	PushInterval time.Duration
+}
+
+// OTLPExporter periodically gathers the APF metrics registered via Register
+// and pushes them to an OTLP collector, translating the underlying
+// compbasemetrics Counter/Gauge/Histogram vecs into OTLP Sum, Gauge, and
+// Histogram data points.
+//
+// This is opt-in (see RegisterOTLPExporter) and is the only thing in this
+// package that depends on the OTel metrics SDK (sdk/metric/metricdata) and
+// the OTLP/gRPC metric exporter (otlpmetricgrpc), as opposed to the OTel
+// trace API this package and k8s.io/apiserver already depend on elsewhere.
+// A cluster operator pulls this in by calling RegisterOTLPExporter with a
+// collector endpoint; nothing in-tree calls it today, the same way nothing
+// in-tree enables the legacy registry's other optional push paths until an
+// apiserver's startup wiring asks for one.
+type OTLPExporter struct {
+	options  OTLPExporterOptions
+	exporter otlpPusher
+
+	lock sync.Mutex
+	// startTimes remembers, per counter or histogram series, the time at which the
+	// series was first observed so cumulative points carry a stable start
+	// timestamp across pushes. This mirrors the created-timestamp
+	// approach used by remote-write exporters so the receiver can tell a
+	// counter reset from ordinary accumulation.
+	startTimes map[string]time.Time
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// otlpPusher is the subset of the OTLP metrics exporter client this package
+// depends on; it exists so tests can substitute a fake.
+type otlpPusher interface {
+	Export(ctx context.Context, rm *metricdata.ResourceMetrics) error
+	Shutdown(ctx context.Context) error
+}
+
+var registerOTLPExporter sync.Once
+
+// RegisterOTLPExporter starts, at most once per process, a background push
+// loop that exports the metrics registered via Register to an OTLP
+// collector using opts. It is a no-op on subsequent calls, matching the
+// idempotent registration behavior of Register.
+func RegisterOTLPExporter(ctx context.Context, opts OTLPExporterOptions) error {
+	var err error
+	registerOTLPExporter.Do(func() {
+		var exp *OTLPExporter
+		exp, err = NewOTLPExporter(opts)
+		if err != nil {
+			return
+		}
+		exp.Start(ctx)
+	})
+	return err
+}
+
+// NewOTLPExporter constructs an OTLPExporter without starting its push
+// loop; callers that need lifecycle control over the goroutine (tests,
+// custom wiring) should use this directly instead of RegisterOTLPExporter.
+func NewOTLPExporter(opts OTLPExporterOptions) (*OTLPExporter, error) {
+	if opts.Endpoint == "" {
+		return nil, fmt.Errorf("OTLP endpoint must be set")
+	}
+	if opts.PushInterval <= 0 {
+		opts.PushInterval = defaultOTLPPushInterval
+	}
+
+	grpcOpts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(opts.Endpoint),
+		otlpmetricgrpc.WithHeaders(opts.Headers),
+	}
+	if opts.TLSConfig != nil {
+		grpcOpts = append(grpcOpts, otlpmetricgrpc.WithTLSCredentials(credentialsFromTLSConfig(opts.TLSConfig)))
+	} else {
+		grpcOpts = append(grpcOpts, otlpmetricgrpc.WithInsecure())
+	}
+
+	exporter, err := otlpmetricgrpc.New(context.Background(), grpcOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build OTLP metric exporter: %w", err)
+	}
+
+	return &OTLPExporter{
+		options:    opts,
+		exporter:   exporter,
+		startTimes: map[string]time.Time{},
+		stopCh:     make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}, nil
+}
+
+// Start launches the background push loop. It returns immediately; the
+// loop stops when ctx is canceled or Stop is called.
+func (e *OTLPExporter) Start(ctx context.Context) {
+	go func() {
+		defer close(e.doneCh)
+		ticker := time.NewTicker(e.options.PushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-e.stopCh:
+				return
+			case <-ticker.C:
+				if err := e.push(ctx); err != nil {
+					klog.ErrorS(err, "Failed to push APF metrics to OTLP collector", "endpoint", e.options.Endpoint)
+				}
+			}
+		}
+	}()
+}
+
+// Stop halts the push loop and shuts down the underlying OTLP client.
+func (e *OTLPExporter) Stop(ctx context.Context) error {
+	close(e.stopCh)
+	<-e.doneCh
+	return e.exporter.Shutdown(ctx)
+}
+
+// apfMetricPrefix is the family name prefix shared by every APF metric
+// (see namespace/subsystem in metrics.go). push uses it to filter the
+// legacy registry down to just the metrics this package registered,
+// since the registry is shared process-wide with every other apiserver
+// metric.
+const apfMetricPrefix = namespace + "_" + subsystem + "_"
+
+// push gathers the current state of the legacy registry and translates it
+// into a single OTLP ResourceMetrics push.
+func (e *OTLPExporter) push(ctx context.Context) error {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather APF metrics: %w", err)
+	}
+
+	rm := e.translate(families)
+
+	// e.lock only needs to protect startTimes, which translate above has
+	// already finished reading/writing by this point; the network call
+	// below must not hold it, or a slow/unreachable collector would block
+	// every other push-loop tick (and anyone else touching startTimes)
+	// for as long as Export takes to time out.
+	return e.exporter.Export(ctx, rm)
+}
+
+// translate holds e.lock just long enough to translate families into a
+// single OTLP ResourceMetrics snapshot and prune startTimes, without
+// holding it across the network call in push.
+func (e *OTLPExporter) translate(families []*dto.MetricFamily) *metricdata.ResourceMetrics {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	seenSeries := make(map[string]bool, len(e.startTimes))
+
+	var scopeMetrics metricdata.ScopeMetrics
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), apfMetricPrefix) {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			seenSeries[seriesKey(family.GetName(), m.GetLabel())] = true
+		}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			scopeMetrics.Metrics = append(scopeMetrics.Metrics, e.translateCounter(family))
+		case dto.MetricType_GAUGE:
+			scopeMetrics.Metrics = append(scopeMetrics.Metrics, e.translateGauge(family))
+		case dto.MetricType_HISTOGRAM:
+			scopeMetrics.Metrics = append(scopeMetrics.Metrics, e.translateHistogram(family))
+		}
+	}
+
+	// Series that no longer appear in the registry (e.g. a flow
+	// distinguisher or priority level was deleted) stop accumulating, so
+	// startTimes doesn't grow without bound across config churn.
+	for key := range e.startTimes {
+		if !seenSeries[key] {
+			delete(e.startTimes, key)
+		}
+	}
+
+	return &metricdata.ResourceMetrics{ScopeMetrics: []metricdata.ScopeMetrics{scopeMetrics}}
+}
+
+// credentialsFromTLSConfig adapts a standard library TLS config to the
+// gRPC transport credentials expected by otlpmetricgrpc.
+func credentialsFromTLSConfig(cfg *tls.Config) credentials.TransportCredentials {
+	return credentials.NewTLS(cfg)
+}
+
+// seriesKey identifies one label-set within a metric family so start times
+// can be tracked per series rather than per family.
+func seriesKey(familyName string, labels []*dto.LabelPair) string {
+	key := familyName
+	for _, l := range labels {
+		key += "," + l.GetName() + "=" + l.GetValue()
+	}
+	return key
+}
+
+func (e *OTLPExporter) startTimeFor(key string, now time.Time) time.Time {
+	if start, ok := e.startTimes[key]; ok {
+		return start
+	}
+	e.startTimes[key] = now
+	return now
+}
+
+func attributesFromLabels(labels []*dto.LabelPair) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(labels))
+	for _, l := range labels {
+		// priorityLevel and flowSchema carry through as resource/instrument
+		// attributes the same way they appear as Prometheus labels today.
+		attrs = append(attrs, attribute.String(l.GetName(), l.GetValue()))
+	}
+	return attrs
+}
+
+func (e *OTLPExporter) translateCounter(family *dto.MetricFamily) metricdata.Metrics {
+	now := time.Now()
+	sum := metricdata.Sum[float64]{IsMonotonic: true, Temporality: metricdata.CumulativeTemporality}
+	for _, m := range family.GetMetric() {
+		key := seriesKey(family.GetName(), m.GetLabel())
+		sum.DataPoints = append(sum.DataPoints, metricdata.DataPoint[float64]{
+			Attributes: attribute.NewSet(attributesFromLabels(m.GetLabel())...),
+			StartTime:  e.startTimeFor(key, now),
+			Time:       now,
+			Value:      m.GetCounter().GetValue(),
+		})
+	}
+	return metricdata.Metrics{Name: family.GetName(), Description: family.GetHelp(), Data: sum}
+}
+
+func (e *OTLPExporter) translateGauge(family *dto.MetricFamily) metricdata.Metrics {
+	now := time.Now()
+	gauge := metricdata.Gauge[float64]{}
+	for _, m := range family.GetMetric() {
+		gauge.DataPoints = append(gauge.DataPoints, metricdata.DataPoint[float64]{
+			Attributes: attribute.NewSet(attributesFromLabels(m.GetLabel())...),
+			Time:       now,
+			Value:      m.GetGauge().GetValue(),
+		})
+	}
+	return metricdata.Metrics{Name: family.GetName(), Description: family.GetHelp(), Data: gauge}
+}
+
+func (e *OTLPExporter) translateHistogram(family *dto.MetricFamily) metricdata.Metrics {
+	now := time.Now()
+	hist := metricdata.Histogram[float64]{Temporality: metricdata.CumulativeTemporality}
+	for _, m := range family.GetMetric() {
+		key := seriesKey(family.GetName(), m.GetLabel())
+		h := m.GetHistogram()
+		buckets := h.GetBucket()
+		bounds := make([]float64, 0, len(buckets))
+		counts := make([]uint64, 0, len(buckets)+1)
+		// dto buckets carry cumulative counts and omit the +Inf bound;
+		// OTLP BucketCounts are per-bucket and require one more entry than
+		// Bounds for the implicit (+Inf) overflow bucket.
+		var prevCumulative uint64
+		for _, b := range buckets {
+			bounds = append(bounds, b.GetUpperBound())
+			counts = append(counts, b.GetCumulativeCount()-prevCumulative)
+			prevCumulative = b.GetCumulativeCount()
+		}
+		counts = append(counts, h.GetSampleCount()-prevCumulative)
+		hist.DataPoints = append(hist.DataPoints, metricdata.HistogramDataPoint[float64]{
+			Attributes:   attribute.NewSet(attributesFromLabels(m.GetLabel())...),
+			StartTime:    e.startTimeFor(key, now),
+			Time:         now,
+			Count:        h.GetSampleCount(),
+			Sum:          h.GetSampleSum(),
+			Bounds:       bounds,
+			BucketCounts: counts,
+		})
+	}
+	return metricdata.Metrics{Name: family.GetName(), Description: family.GetHelp(), Data: hist}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func float64Ptr(v float64) *float64 { return &v }
+func uint64Ptr(v uint64) *uint64    { return &v }
+func stringPtr(v string) *string    { return &v }
+
+func TestTranslateHistogramBucketCounts(t *testing.T) {
+	family := &dto.MetricFamily{
+		Name: stringPtr("apiserver_flowcontrol_request_wait_duration_seconds"),
+		Help: stringPtr("wait duration"),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{Name: stringPtr(priorityLevel), Value: stringPtr("workload-low")},
+				},
+				Histogram: &dto.Histogram{
+					SampleCount: uint64Ptr(10),
+					SampleSum:   float64Ptr(4.2),
+					Bucket: []*dto.Bucket{
+						{UpperBound: float64Ptr(0.1), CumulativeCount: uint64Ptr(2)},
+						{UpperBound: float64Ptr(0.5), CumulativeCount: uint64Ptr(5)},
+						{UpperBound: float64Ptr(1.0), CumulativeCount: uint64Ptr(8)},
+					},
+				},
+			},
+		},
+	}
+
+	exp := &OTLPExporter{startTimes: map[string]time.Time{}}
+	metric := exp.translateHistogram(family)
+
+	hist, ok := metric.Data.(metricdata.Histogram[float64])
+	if !ok {
+		t.Fatalf("translateHistogram returned unexpected Data type %T", metric.Data)
+	}
+	if len(hist.DataPoints) != 1 {
+		t.Fatalf("expected 1 data point, got %d", len(hist.DataPoints))
+	}
+
+	dp := hist.DataPoints[0]
+
+	wantBounds := []float64{0.1, 0.5, 1.0}
+	if !reflect.DeepEqual(dp.Bounds, wantBounds) {
+		t.Errorf("Bounds = %v, want %v (must not include +Inf)", dp.Bounds, wantBounds)
+	}
+
+	// Per-bucket (non-cumulative) counts: 2, 5-2=3, 8-5=3, and the
+	// trailing +Inf overflow bucket 10-8=2.
+	wantCounts := []uint64{2, 3, 3, 2}
+	if !reflect.DeepEqual(dp.BucketCounts, wantCounts) {
+		t.Errorf("BucketCounts = %v, want %v", dp.BucketCounts, wantCounts)
+	}
+
+	if len(dp.BucketCounts) != len(dp.Bounds)+1 {
+		t.Errorf("len(BucketCounts) = %d, want len(Bounds)+1 = %d", len(dp.BucketCounts), len(dp.Bounds)+1)
+	}
+	if dp.Count != 10 {
+		t.Errorf("Count = %d, want 10", dp.Count)
+	}
+}
@@ -0,0 +1,348 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	compbasemetrics "k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// rateSampleInterval is how often the background sampler reads the
+// cumulative counters and seat gauges to update the rate/saturation
+// gauges below.
+const rateSampleInterval = 5 * time.Second
+
+// rateWindows are the sliding windows exposed on the "window" label of
+// apiserver_flowcontrol_rejection_rate and apiserver_flowcontrol_dispatch_rate,
+// following the same 1m/5m/15m convention as the Unix load average.
+var rateWindows = []struct {
+	name   string
+	period time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+var (
+	apiserverRejectionRate = compbasemetrics.NewGaugeVec(
+		&compbasemetrics.GaugeOpts{
+			Namespace:      namespace,
+			Subsystem:      subsystem,
+			Name:           "rejection_rate",
+			Help:           "Sliding-window rate, in requests per second, at which requests are being rejected by API Priority and Fairness, by priority level and window",
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+		[]string{priorityLevel, "window"},
+	)
+	apiserverDispatchRate = compbasemetrics.NewGaugeVec(
+		&compbasemetrics.GaugeOpts{
+			Namespace:      namespace,
+			Subsystem:      subsystem,
+			Name:           "dispatch_rate",
+			Help:           "Sliding-window rate, in requests per second, at which requests are being dispatched by API Priority and Fairness, by priority level and window",
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+		[]string{priorityLevel, "window"},
+	)
+	apiserverSeatSaturationRatio = compbasemetrics.NewGaugeVec(
+		&compbasemetrics.GaugeOpts{
+			Namespace:      namespace,
+			Subsystem:      subsystem,
+			Name:           "seat_saturation_ratio",
+			Help:           "Ratio of seats currently in use to the configured concurrency limit, by priority level",
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+		[]string{priorityLevel},
+	)
+)
+
+func init() {
+	metrics = metrics.Append(apiserverRejectionRate, apiserverDispatchRate, apiserverSeatSaturationRatio)
+}
+
+// ewma is a single load-average style exponentially weighted moving
+// average accumulator, decayed once per rateSampleInterval.
+type ewma struct {
+	decay float64
+	value float64
+	set   bool
+}
+
+func newEWMA(period time.Duration) *ewma {
+	return &ewma{decay: math.Exp(-float64(rateSampleInterval) / float64(period))}
+}
+
+// observe folds in a new per-second rate sample, following the same decay
+// formula the Unix load average uses.
+func (e *ewma) observe(rate float64) {
+	if !e.set {
+		e.value = rate
+		e.set = true
+		return
+	}
+	e.value = e.value*e.decay + rate*(1-e.decay)
+}
+
+// rateTracker accumulates the rejected/dispatched cumulative counts for one
+// priority level into the sliding-window EWMAs.
+type rateTracker struct {
+	lastRejected, lastDispatched float64
+	lastSampleTime               time.Time
+	rejected, dispatched         []*ewma
+}
+
+func newRateTracker() *rateTracker {
+	t := &rateTracker{}
+	for _, w := range rateWindows {
+		t.rejected = append(t.rejected, newEWMA(w.period))
+		t.dispatched = append(t.dispatched, newEWMA(w.period))
+	}
+	return t
+}
+
+var (
+	rateTrackersLock sync.Mutex
+	rateTrackers     = map[string]*rateTracker{}
+	startRateSampler sync.Once
+
+	// seatSaturationLevels remembers which priority levels currently have
+	// an apiserver_flowcontrol_seat_saturation_ratio series published, so a
+	// level that stops reporting a concurrency limit (deleted, not merely
+	// idle) can have its saturation gauge dropped instead of lingering at
+	// its last value forever.
+	seatSaturationLevels = map[string]bool{}
+)
+
+// StartRateSampler launches, at most once per process, the background
+// goroutine that periodically derives the rejection/dispatch rate and seat
+// saturation gauges from the existing cumulative counters and seat gauges.
+// This lets alerting rules fire on e.g. rejection_rate > X for a window
+// without requiring PromQL rate() or depending on scrape cadence.
+func StartRateSampler(ctx context.Context) {
+	startRateSampler.Do(func() {
+		go func() {
+			ticker := time.NewTicker(rateSampleInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-ticker.C:
+					sampleRates(now)
+				}
+			}
+		}()
+	})
+}
+
+// sampleRates reads the current cumulative totals and seat-in-use/limit
+// gauges, folds the resulting per-second rates into each priority level's
+// sliding windows, and republishes the exposed gauges.
+func sampleRates(now time.Time) {
+	rejectedMetric := namespace + "_" + subsystem + "_rejected_requests_total"
+	dispatchedMetric := namespace + "_" + subsystem + "_dispatched_requests_total"
+	inUseMetric := namespace + "_" + subsystem + "_request_concurrency_in_use"
+	limitMetric := namespace + "_" + subsystem + "_request_concurrency_limit"
+
+	sums := sumManyByPriorityLevel(rejectedMetric, dispatchedMetric, inUseMetric, limitMetric)
+	rejectedByLevel, dispatchedByLevel := sums[rejectedMetric], sums[dispatchedMetric]
+	inUseByLevel, limitByLevel := sums[inUseMetric], sums[limitMetric]
+
+	rateTrackersLock.Lock()
+	defer rateTrackersLock.Unlock()
+
+	// Iterate every priority level seen in either counter so a level with
+	// zero rejections (or zero dispatches) still gets its rate gauges
+	// published instead of silently missing one of the two series.
+	seenLevels := map[string]bool{}
+	for level := range rejectedByLevel {
+		seenLevels[level] = true
+	}
+	for level := range dispatchedByLevel {
+		seenLevels[level] = true
+	}
+
+	for level := range seenLevels {
+		rejected, dispatched := rejectedByLevel[level], dispatchedByLevel[level]
+		tracker, ok := rateTrackers[level]
+		if !ok {
+			tracker = newRateTracker()
+			tracker.lastSampleTime = now
+			tracker.lastRejected = rejected
+			tracker.lastDispatched = dispatched
+			rateTrackers[level] = tracker
+			continue
+		}
+		elapsed := now.Sub(tracker.lastSampleTime).Seconds()
+		if elapsed <= 0 {
+			continue
+		}
+		rejectRate := (rejected - tracker.lastRejected) / elapsed
+		dispatchRate := (dispatched - tracker.lastDispatched) / elapsed
+		tracker.lastRejected = rejected
+		tracker.lastDispatched = dispatched
+		tracker.lastSampleTime = now
+
+		for i, w := range rateWindows {
+			tracker.rejected[i].observe(rejectRate)
+			tracker.dispatched[i].observe(dispatchRate)
+			apiserverRejectionRate.WithLabelValues(level, w.name).Set(tracker.rejected[i].value)
+			apiserverDispatchRate.WithLabelValues(level, w.name).Set(tracker.dispatched[i].value)
+		}
+	}
+
+	// Priority levels that have been deleted (no longer in either
+	// counter) stop accumulating and get dropped, so rateTrackers and the
+	// exposed series don't grow without bound across config churn.
+	for level := range rateTrackers {
+		if !seenLevels[level] {
+			delete(rateTrackers, level)
+			apiserverRejectionRate.DeletePartialMatch(map[string]string{priorityLevel: level})
+			apiserverDispatchRate.DeletePartialMatch(map[string]string{priorityLevel: level})
+		}
+	}
+
+	currentSaturationLevels := map[string]bool{}
+	for level, limit := range limitByLevel {
+		if limit <= 0 {
+			continue
+		}
+		apiserverSeatSaturationRatio.WithLabelValues(level).Set(inUseByLevel[level] / limit)
+		currentSaturationLevels[level] = true
+	}
+
+	// Priority levels that no longer report a concurrency limit (deleted,
+	// not merely idle — an idle-but-configured level still appears in
+	// limitByLevel) stop having their saturation gauge refreshed above, so
+	// it must be dropped explicitly or it lingers at its last value
+	// forever, unlike rejection_rate/dispatch_rate which get the same
+	// treatment just above via rateTrackers.
+	for level := range seatSaturationLevels {
+		if !currentSaturationLevels[level] {
+			apiserverSeatSaturationRatio.DeletePartialMatch(map[string]string{priorityLevel: level})
+		}
+	}
+	seatSaturationLevels = currentSaturationLevels
+}
+
+// flowKeysSeenLock guards flowKeysSeen, the most recent snapshot of
+// (priorityLevel, flowSchema) pairs observed by sumManyByPriorityLevel's
+// Gather call. pruneFlowDistinguisherMetrics in topk.go reads this instead
+// of issuing its own Gather, so the rate sampler and the flow-distinguisher
+// pruner don't each walk the entire process-wide registry on their own
+// independent timer. A Gather error leaves the previous snapshot in place
+// rather than clearing it, so a transient collection failure elsewhere in
+// the registry doesn't look like every priority level/flow schema having
+// been deleted.
+var (
+	flowKeysSeenLock  sync.Mutex
+	flowKeysSeen      = map[flowKey]bool{}
+	flowKeysSeenReady bool
+)
+
+// currentFlowKeys returns a copy of the most recent (priorityLevel,
+// flowSchema) snapshot captured by sumManyByPriorityLevel, plus whether
+// sumManyByPriorityLevel has completed at least one successful Gather yet.
+// A caller must treat ready == false as "unknown", not "nothing seen",
+// since the rate sampler and the flow-distinguisher pruner run on
+// independent tickers and the pruner's first tick could otherwise race
+// ahead of the rate sampler's first one.
+func currentFlowKeys() (seen map[flowKey]bool, ready bool) {
+	flowKeysSeenLock.Lock()
+	defer flowKeysSeenLock.Unlock()
+	seen = make(map[flowKey]bool, len(flowKeysSeen))
+	for k := range flowKeysSeen {
+		seen[k] = true
+	}
+	return seen, flowKeysSeenReady
+}
+
+// sumManyByPriorityLevel gathers the legacy registry once and sums each of
+// metricNames' values across all non-priorityLevel labels (e.g.
+// flow_schema, reason), returning one total per priority level per metric
+// name. A single Gather() call is shared across all of them since Gather
+// walks the entire process-wide registry regardless of how many families
+// the caller actually wants. As a side effect, it also refreshes
+// flowKeysSeen from whichever of metricNames' families carry both a
+// priorityLevel and a flowSchema label, since it has already paid for the only Gather
+// call these requests need.
+func sumManyByPriorityLevel(metricNames ...string) map[string]map[string]float64 {
+	wanted := make(map[string]bool, len(metricNames))
+	for _, name := range metricNames {
+		wanted[name] = true
+	}
+
+	totals := make(map[string]map[string]float64, len(metricNames))
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		return totals
+	}
+
+	seen := map[flowKey]bool{}
+	for _, family := range families {
+		name := family.GetName()
+		if !wanted[name] {
+			continue
+		}
+		levelTotals := totals[name]
+		if levelTotals == nil {
+			levelTotals = map[string]float64{}
+			totals[name] = levelTotals
+		}
+		for _, m := range family.GetMetric() {
+			var level, schema string
+			var hasFlowSchema bool
+			for _, l := range m.GetLabel() {
+				switch l.GetName() {
+				case priorityLevel:
+					level = l.GetValue()
+				case flowSchema:
+					hasFlowSchema = true
+					schema = l.GetValue()
+				}
+			}
+			if level == "" {
+				continue
+			}
+			levelTotals[level] += metricValue(family.GetType(), m)
+			if hasFlowSchema {
+				seen[flowKey{priorityLevel: level, flowSchema: schema}] = true
+			}
+		}
+	}
+
+	flowKeysSeenLock.Lock()
+	flowKeysSeen = seen
+	flowKeysSeenReady = true
+	flowKeysSeenLock.Unlock()
+
+	return totals
+}
+
+func metricValue(t dto.MetricType, m *dto.Metric) float64 {
+	if t == dto.MetricType_GAUGE {
+		return m.GetGauge().GetValue()
+	}
+	return m.GetCounter().GetValue()
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	compbasemetrics "k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	// flowDistinguisherTopK bounds how many distinguishers per
+	// (priorityLevel, flowSchema) get their own Prometheus series; the
+	// rest are folded into otherDistinguisher.
+	flowDistinguisherTopK = 10
+	// flowDistinguisherSketchCapacity is how many distinguishers the
+	// underlying Misra-Gries sketch tracks, well above flowDistinguisherTopK
+	// so there is a genuine long tail left to fold into otherDistinguisher
+	// once the exposed gauges are trimmed to the top K. Sizing the sketch to
+	// exactly K would make every tracked key "top-K" by definition and the
+	// tail would just be evicted silently instead of surfaced.
+	flowDistinguisherSketchCapacity = flowDistinguisherTopK * 10
+	// otherDistinguisher is the label value series for distinguishers that
+	// did not make the current top-K.
+	otherDistinguisher = "__other__"
+	// flowDistinguisherPruneInterval is how often the top-K is recomputed
+	// and swapped into the exposed gauges.
+	flowDistinguisherPruneInterval = 30 * time.Second
+)
+
+var (
+	apiserverFlowDistinguisherDispatchedTotal = compbasemetrics.NewGaugeVec(
+		&compbasemetrics.GaugeOpts{
+			Namespace:      namespace,
+			Subsystem:      subsystem,
+			Name:           "flow_distinguisher_dispatched_requests",
+			Help:           "Approximate count of dispatched requests for the heaviest flow distinguishers (e.g. users, namespaces) of each priority level and flow schema, long tail folded into " + otherDistinguisher,
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+		[]string{priorityLevel, flowSchema, "distinguisher"},
+	)
+	apiserverFlowDistinguisherSeatSeconds = compbasemetrics.NewGaugeVec(
+		&compbasemetrics.GaugeOpts{
+			Namespace:      namespace,
+			Subsystem:      subsystem,
+			Name:           "flow_distinguisher_seat_seconds",
+			Help:           "Approximate seat-seconds consumed by the heaviest flow distinguishers (e.g. users, namespaces) of each priority level and flow schema, long tail folded into " + otherDistinguisher,
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+		[]string{priorityLevel, flowSchema, "distinguisher"},
+	)
+)
+
+var registerFlowDistinguisherMetrics sync.Once
+
+// RegisterFlowDistinguisherMetrics registers the per-flow-distinguisher
+// top-K gauges and starts the background pruner that maintains them.
+// Unlike the rest of this package's metrics, these gauges are only ever
+// populated by a caller that wires ObserveFlowDispatch into its dispatch
+// path, so registration is opt-in rather than folded into Register —
+// registering them unconditionally would publish permanently-empty
+// families for every apiserver that hasn't done that wiring.
+func RegisterFlowDistinguisherMetrics() {
+	registerFlowDistinguisherMetrics.Do(func() {
+		legacyregistry.MustRegister(apiserverFlowDistinguisherDispatchedTotal)
+		legacyregistry.MustRegister(apiserverFlowDistinguisherSeatSeconds)
+		StartFlowDistinguisherPruner(context.Background())
+	})
+}
+
+// misraGriesSketch is a fixed-capacity frequency sketch (Misra-Gries / a
+// counter-based cousin of Space-Saving) that tracks the heaviest keys by
+// weight while using memory bounded by its capacity regardless of how many
+// distinct keys are ever seen.
+type misraGriesSketch struct {
+	capacity int
+	counts   map[string]float64
+}
+
+func newMisraGriesSketch(capacity int) *misraGriesSketch {
+	return &misraGriesSketch{capacity: capacity, counts: make(map[string]float64, capacity)}
+}
+
+// add records weight for key, evicting the lightest tracked keys if the
+// sketch is over capacity.
+//
+// Note a known limitation of classic Misra-Gries here: when over capacity,
+// an unseen key is never admitted, no matter how large its weight — every
+// tracked counter is decremented by weight instead. For the byCount sketch
+// (weight always 1) this is the standard, well-behaved algorithm. For
+// bySeatSecond, where weight is a per-request seat-seconds value that can
+// vary by orders of magnitude, a genuinely heavy new tenant arriving this
+// round is discarded outright while lighter incumbents merely get
+// decremented, which can understate which tenant is actually filling up a
+// priority level. A Space-Saving variant (admit the newcomer at the
+// evicted minimum plus an error bound) would track this case better; this
+// sketch trades that accuracy for the simplicity of not tracking per-key
+// error bounds.
+func (s *misraGriesSketch) add(key string, weight float64) {
+	if _, ok := s.counts[key]; ok {
+		s.counts[key] += weight
+		return
+	}
+	if len(s.counts) < s.capacity {
+		s.counts[key] = weight
+		return
+	}
+	// Over capacity: decrement every tracked counter by weight (the
+	// standard Misra-Gries step) and evict anything that hits zero,
+	// rather than adding key outright. This keeps the heaviest hitters
+	// from the long tail crowding them out.
+	for k, v := range s.counts {
+		v -= weight
+		if v <= 0 {
+			delete(s.counts, k)
+			continue
+		}
+		s.counts[k] = v
+	}
+}
+
+// topK returns up to k keys with the largest tracked weight, descending.
+func (s *misraGriesSketch) topK(k int) []string {
+	type kv struct {
+		key    string
+		weight float64
+	}
+	entries := make([]kv, 0, len(s.counts))
+	for key, weight := range s.counts {
+		entries = append(entries, kv{key, weight})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].weight > entries[j].weight })
+	if len(entries) > k {
+		entries = entries[:k]
+	}
+	result := make([]string, len(entries))
+	for i, e := range entries {
+		result[i] = e.key
+	}
+	return result
+}
+
+// flowKey identifies the (priorityLevel, flowSchema) pair a distinguisher
+// tracker belongs to.
+type flowKey struct {
+	priorityLevel string
+	flowSchema    string
+}
+
+// flowDistinguisherTracker keeps the two sketches (by dispatched count and
+// by seat-seconds) for one priority level / flow schema pair.
+type flowDistinguisherTracker struct {
+	byCount      *misraGriesSketch
+	bySeatSecond *misraGriesSketch
+}
+
+var (
+	flowDistinguisherLock        sync.Mutex
+	flowDistinguisherTrackers    = map[flowKey]*flowDistinguisherTracker{}
+	startFlowDistinguisherPruner sync.Once
+)
+
+// ObserveFlowDispatch records one dispatched request's distinguisher
+// (e.g. the requesting user or namespace) against the bounded top-K
+// trackers for its priority level and flow schema. It is safe to call from
+// any number of concurrent requests.
+func ObserveFlowDispatch(ctx context.Context, priorityLevel, flowSchema, distinguisher string, seats int, execDuration time.Duration) {
+	key := flowKey{priorityLevel: priorityLevel, flowSchema: flowSchema}
+	seatSeconds := float64(seats) * execDuration.Seconds()
+
+	flowDistinguisherLock.Lock()
+	tracker, ok := flowDistinguisherTrackers[key]
+	if !ok {
+		tracker = &flowDistinguisherTracker{
+			byCount:      newMisraGriesSketch(flowDistinguisherSketchCapacity),
+			bySeatSecond: newMisraGriesSketch(flowDistinguisherSketchCapacity),
+		}
+		flowDistinguisherTrackers[key] = tracker
+	}
+	tracker.byCount.add(distinguisher, 1)
+	tracker.bySeatSecond.add(distinguisher, seatSeconds)
+	flowDistinguisherLock.Unlock()
+}
+
+// StartFlowDistinguisherPruner launches, at most once per process, the
+// background goroutine that periodically swaps the current top-K
+// distinguishers into the exposed gauges and folds everything else into
+// otherDistinguisher. RegisterFlowDistinguisherMetrics calls this; callers
+// that need lifecycle control over the goroutine independent of
+// registration (tests, custom wiring) can call it directly instead.
+func StartFlowDistinguisherPruner(ctx context.Context) {
+	startFlowDistinguisherPruner.Do(func() {
+		go func() {
+			ticker := time.NewTicker(flowDistinguisherPruneInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					pruneFlowDistinguisherMetrics()
+				}
+			}
+		}()
+	})
+}
+
+// pruneFlowDistinguisherMetrics recomputes, for every tracked
+// (priorityLevel, flowSchema), the current top-K distinguishers by count
+// and by seat-seconds, and replaces the exposed series with just those
+// plus a single otherDistinguisher rollup. The replacement is not atomic:
+// both gauges are Reset first and then repopulated series by series, so a
+// scrape that lands in between sees only part of the series.
+func pruneFlowDistinguisherMetrics() {
+	flowDistinguisherLock.Lock()
+	snapshot := make(map[flowKey]*flowDistinguisherTracker, len(flowDistinguisherTrackers))
+	for k, v := range flowDistinguisherTrackers {
+		snapshot[k] = v
+	}
+	flowDistinguisherLock.Unlock()
+
+	apiserverFlowDistinguisherDispatchedTotal.Reset()
+	apiserverFlowDistinguisherSeatSeconds.Reset()
+
+	for key, tracker := range snapshot {
+		flowDistinguisherLock.Lock()
+		var otherCount, otherSeatSeconds float64
+		top := tracker.byCount.topK(flowDistinguisherTopK)
+		topSet := make(map[string]bool, len(top))
+		for _, d := range top {
+			topSet[d] = true
+			apiserverFlowDistinguisherDispatchedTotal.WithLabelValues(key.priorityLevel, key.flowSchema, d).Set(tracker.byCount.counts[d])
+		}
+		for d, c := range tracker.byCount.counts {
+			if !topSet[d] {
+				otherCount += c
+			}
+		}
+		topSeat := tracker.bySeatSecond.topK(flowDistinguisherTopK)
+		topSeatSet := make(map[string]bool, len(topSeat))
+		for _, d := range topSeat {
+			topSeatSet[d] = true
+			apiserverFlowDistinguisherSeatSeconds.WithLabelValues(key.priorityLevel, key.flowSchema, d).Set(tracker.bySeatSecond.counts[d])
+		}
+		for d, c := range tracker.bySeatSecond.counts {
+			if !topSeatSet[d] {
+				otherSeatSeconds += c
+			}
+		}
+		flowDistinguisherLock.Unlock()
+
+		if otherCount > 0 {
+			apiserverFlowDistinguisherDispatchedTotal.WithLabelValues(key.priorityLevel, key.flowSchema, otherDistinguisher).Set(otherCount)
+		}
+		if otherSeatSeconds > 0 {
+			apiserverFlowDistinguisherSeatSeconds.WithLabelValues(key.priorityLevel, key.flowSchema, otherDistinguisher).Set(otherSeatSeconds)
+		}
+	}
+
+	// Priority level / flow schema pairs that have been deleted (no longer
+	// appear in the request counters or the seats-in-use gauge that
+	// sampleRates reads) stop accumulating and get dropped,
+	// mirroring how sampleRates prunes rateTrackers in rates.go so
+	// flowDistinguisherTrackers doesn't grow without bound across config
+	// churn. currentFlowKeys reads the snapshot sampleRates already
+	// refreshed on its own ticker rather than issuing a second Gather of
+	// the whole registry here. If the rate sampler hasn't produced a
+	// snapshot yet (e.g. this pruner's first tick races ahead of the rate
+	// sampler's first one), skip pruning this round rather than treating
+	// every tracked key as deleted.
+	seen, ready := currentFlowKeys()
+	if !ready {
+		return
+	}
+	flowDistinguisherLock.Lock()
+	for key := range flowDistinguisherTrackers {
+		if !seen[key] {
+			delete(flowDistinguisherTrackers, key)
+			apiserverFlowDistinguisherDispatchedTotal.DeletePartialMatch(map[string]string{priorityLevel: key.priorityLevel, flowSchema: key.flowSchema})
+			apiserverFlowDistinguisherSeatSeconds.DeletePartialMatch(map[string]string{priorityLevel: key.priorityLevel, flowSchema: key.flowSchema})
+		}
+	}
+	flowDistinguisherLock.Unlock()
+}
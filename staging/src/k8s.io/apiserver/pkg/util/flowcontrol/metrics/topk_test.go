@@ -0,0 +1,88 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMisraGriesSketchTopKOrdering(t *testing.T) {
+	s := newMisraGriesSketch(3)
+	s.add("a", 5)
+	s.add("b", 3)
+	s.add("c", 1)
+
+	got := s.topK(2)
+	want := []string{"a", "b"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("topK(2) = %v, want %v", got, want)
+	}
+}
+
+func TestMisraGriesSketchEvictsUnderCapacityPressure(t *testing.T) {
+	s := newMisraGriesSketch(2)
+	s.add("a", 1)
+	s.add("b", 1)
+	// Over capacity: the Misra-Gries decrement step runs instead of adding
+	// "c" outright, and the lightest tracked keys are evicted.
+	s.add("c", 1)
+
+	if len(s.counts) > 2 {
+		t.Fatalf("sketch grew past capacity: %v", s.counts)
+	}
+}
+
+// TestMisraGriesSketchLeavesATailForOther exercises the bug the review
+// flagged: a sketch sized to exactly K would make every tracked key part of
+// the "top K" by definition, so there would never be a tail left over to
+// fold into otherDistinguisher. Sizing the sketch well above K (as
+// flowDistinguisherSketchCapacity does) must leave untracked-by-topK keys
+// in s.counts for the __other__ rollup to sum.
+func TestMisraGriesSketchLeavesATailForOther(t *testing.T) {
+	const k = 2
+	s := newMisraGriesSketch(k * 10)
+	for i, weight := range []float64{100, 90, 5, 4, 3, 2, 1} {
+		s.add(fmt.Sprintf("key-%d", i), weight)
+	}
+
+	top := s.topK(k)
+	if len(top) != k {
+		t.Fatalf("topK(%d) returned %d keys, want %d", k, len(top), k)
+	}
+
+	topSet := make(map[string]bool, len(top))
+	for _, key := range top {
+		topSet[key] = true
+	}
+
+	var otherCount float64
+	tailKeys := 0
+	for key, weight := range s.counts {
+		if !topSet[key] {
+			otherCount += weight
+			tailKeys++
+		}
+	}
+
+	if tailKeys == 0 {
+		t.Fatal("sketch has no tail beyond the top K; __other__ would always be 0")
+	}
+	if otherCount <= 0 {
+		t.Fatalf("otherCount = %v, want > 0", otherCount)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestEventSink receives one event per step of a request's life in API
+// Priority and Fairness: enqueue, dispatch, the wait that precedes it,
+// execution end, estimated seats, and reject. The default implementation attaches each
+// event to the span already active on the request's context, giving
+// operators per-request drill-down (which flow schema throttled a specific
+// user's request) that the aggregate histograms in this package cannot
+// provide.
+type RequestEventSink interface {
+	// Enqueue is called when a request is placed into a priority level's queue.
+	Enqueue(ctx context.Context, priorityLevel, flowSchema string, queueLength int)
+	// Dispatch is called when a request is released from its queue for execution.
+	Dispatch(ctx context.Context, priorityLevel, flowSchema string)
+	// Wait is called once a dispatched request's time in queue is known.
+	Wait(ctx context.Context, priorityLevel, flowSchema, execute string, waitTime time.Duration)
+	// ExecutionEnd is called when a dispatched request finishes executing.
+	ExecutionEnd(ctx context.Context, priorityLevel, flowSchema string, executionTime time.Duration)
+	// EstimatedSeats is called when a request's estimated seat occupancy is computed.
+	EstimatedSeats(ctx context.Context, priorityLevel, flowSchema string, seats int)
+	// Reject is called when a request is turned away without being queued or dispatched.
+	Reject(ctx context.Context, priorityLevel, flowSchema, reason string)
+}
+
+// spanEventSink is the default RequestEventSink: it emits each lifecycle
+// step as an event on the span already active on the request's context,
+// doing nothing if no span is recording.
+type spanEventSink struct{}
+
+// NewSpanRequestEventSink returns the default RequestEventSink, which emits
+// APF lifecycle events onto the span active on each request's context.
+func NewSpanRequestEventSink() RequestEventSink {
+	return spanEventSink{}
+}
+
+func (spanEventSink) Enqueue(ctx context.Context, priorityLevel, flowSchema string, queueLength int) {
+	addSpanEvent(ctx, "apf.enqueue",
+		attribute.String("priority_level", priorityLevel),
+		attribute.String("flow_schema", flowSchema),
+		attribute.Int("queue_length", queueLength),
+	)
+}
+
+func (spanEventSink) Dispatch(ctx context.Context, priorityLevel, flowSchema string) {
+	addSpanEvent(ctx, "apf.dispatch",
+		attribute.String("priority_level", priorityLevel),
+		attribute.String("flow_schema", flowSchema),
+	)
+}
+
+func (spanEventSink) Wait(ctx context.Context, priorityLevel, flowSchema, execute string, waitTime time.Duration) {
+	addSpanEvent(ctx, "apf.wait",
+		attribute.String("priority_level", priorityLevel),
+		attribute.String("flow_schema", flowSchema),
+		attribute.String("execute", execute),
+		attribute.Float64("wait_duration_seconds", waitTime.Seconds()),
+	)
+}
+
+func (spanEventSink) ExecutionEnd(ctx context.Context, priorityLevel, flowSchema string, executionTime time.Duration) {
+	addSpanEvent(ctx, "apf.execution_end",
+		attribute.String("priority_level", priorityLevel),
+		attribute.String("flow_schema", flowSchema),
+		attribute.Float64("execution_duration_seconds", executionTime.Seconds()),
+	)
+}
+
+func (spanEventSink) EstimatedSeats(ctx context.Context, priorityLevel, flowSchema string, seats int) {
+	addSpanEvent(ctx, "apf.estimated_seats",
+		attribute.String("priority_level", priorityLevel),
+		attribute.String("flow_schema", flowSchema),
+		attribute.Int("seats", seats),
+	)
+}
+
+func (spanEventSink) Reject(ctx context.Context, priorityLevel, flowSchema, reason string) {
+	addSpanEvent(ctx, "apf.reject",
+		attribute.String("priority_level", priorityLevel),
+		attribute.String("flow_schema", flowSchema),
+		attribute.String("reason", reason),
+	)
+}
+
+// addSpanEvent is a no-op when ctx carries no recording span, so callers on
+// the hot path never pay for tracing they haven't enabled.
+func addSpanEvent(ctx context.Context, name string, attrs ...attribute.KeyValue) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	span.AddEvent(name, trace.WithAttributes(attrs...))
+}
+
+// eventSink holds the RequestEventSink wired into the Observe*/Add* hooks
+// below, as an atomic.Value so SetRequestEventSink can be called safely
+// even while those hooks are already being read concurrently from the
+// request-serving hot path. It defaults to the span-based sink and can be
+// swapped by callers that want a different backend (e.g. in tests).
+var eventSink atomic.Value // RequestEventSink
+
+func init() {
+	eventSink.Store(NewSpanRequestEventSink())
+}
+
+// currentEventSink returns the RequestEventSink currently installed.
+func currentEventSink() RequestEventSink {
+	return eventSink.Load().(RequestEventSink)
+}
+
+// SetRequestEventSink replaces the RequestEventSink used by the Observe*/Add*
+// hooks in this package. It is intended for tests and for callers wiring up
+// an alternative tracing backend at startup. It is safe to call concurrently
+// with request serving.
+func SetRequestEventSink(sink RequestEventSink) {
+	eventSink.Store(sink)
+}